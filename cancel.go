@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// withRunTimeout derives a context bounded by -timeout from parent, or a
+// plain cancelable context if -timeout is unset (0).
+func withRunTimeout(parent context.Context) (context.Context, context.CancelFunc) {
+	if *timeoutFlag <= 0 {
+		return context.WithCancel(parent)
+	}
+	return context.WithTimeout(parent, *timeoutFlag)
+}
+
+// drainFor reads and discards from outLines/errLines for up to d, so a
+// preempted run's trailing output doesn't leak into the next one.
+func drainFor(outLines, errLines <-chan string, d time.Duration) {
+	deadline := time.After(d)
+	for {
+		select {
+		case _, ok := <-outLines:
+			if !ok {
+				return
+			}
+		case _, ok := <-errLines:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			return
+		}
+	}
+}
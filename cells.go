@@ -0,0 +1,177 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// cell is a named region of the scratch file, delimited by a
+// "<linePrefix>@cell <name>" line and a following "<linePrefix>@end" line.
+// Cells don't nest; a "@cell" found before the previous one's "@end" starts
+// a new cell and implicitly closes the previous one at that point.
+type cell struct {
+	name               string
+	bodyStart, bodyEnd int // line indices of the cell's body, @cell and @end excluded
+}
+
+// body returns the cell's contents (excluding its @cell/@end marker lines)
+// joined back with newlines.
+func (c cell) body(lines []string) string {
+	return strings.Join(lines[c.bodyStart:c.bodyEnd], "\n")
+}
+
+// parseCells scans lines for cell markers and returns the cells found, in
+// file order.
+func parseCells(lines []string, linePrefix string) []cell {
+	cellStart := linePrefix + "@cell "
+	cellEnd := linePrefix + "@end"
+
+	var cells []cell
+	cur := (*cell)(nil)
+	for i, line := range lines {
+		switch {
+		case strings.HasPrefix(line, cellStart):
+			if cur != nil {
+				cur.bodyEnd = i
+				cells = append(cells, *cur)
+			}
+			cur = &cell{name: strings.TrimSpace(strings.TrimPrefix(line, cellStart)), bodyStart: i + 1}
+		case strings.TrimSpace(line) == cellEnd:
+			if cur != nil {
+				cur.bodyEnd = i
+				cells = append(cells, *cur)
+				cur = nil
+			}
+		}
+	}
+	if cur != nil {
+		cur.bodyEnd = len(lines)
+		cells = append(cells, *cur)
+	}
+	return cells
+}
+
+// findCell returns the cell named name, or nil if there's none.
+func findCell(cells []cell, name string) *cell {
+	for i := range cells {
+		if cells[i].name == name {
+			return &cells[i]
+		}
+	}
+	return nil
+}
+
+// runDirective returns the cell name requested via a "<linePrefix>@run <name>"
+// line anywhere in lines, or "" if there's none.
+func runDirective(lines []string, linePrefix string) string {
+	prefix := linePrefix + "@run "
+	for _, line := range lines {
+		if strings.HasPrefix(line, prefix) {
+			return strings.TrimSpace(strings.TrimPrefix(line, prefix))
+		}
+	}
+	return ""
+}
+
+const scratchEndMarker = "~~ end scratch ~~"
+
+var scratchMarkerRe = regexp.MustCompile(`^~~ scratch(?: (.+))? ~~$`)
+
+// scratchMarker returns the sentinel line that starts the scratch output
+// section for the given cell name ("" for the whole-file section).
+func scratchMarker(linePrefix, cellName string) string {
+	if cellName == "" {
+		return linePrefix + "~~ scratch ~~"
+	}
+	return linePrefix + "~~ scratch " + cellName + " ~~"
+}
+
+// scratchMarkerName reports whether line is a scratch marker written by
+// scratchMarker, and if so for which cell name ("" for the whole-file one).
+func scratchMarkerName(line, linePrefix string) (name string, ok bool) {
+	if !strings.HasPrefix(line, linePrefix) {
+		return "", false
+	}
+	m := scratchMarkerRe.FindStringSubmatch(strings.TrimPrefix(line, linePrefix))
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// scratchBlockLines renders a full scratch section (marker, output lines,
+// end marker) for the given cell name. output's lines are written as they
+// are: they already carry linePrefix (see formatRunOutput).
+func scratchBlockLines(linePrefix, cellName, output string) []string {
+	lines := []string{scratchMarker(linePrefix, cellName)}
+	if output != "" {
+		lines = append(lines, strings.Split(strings.TrimSuffix(output, "\n"), "\n")...)
+	}
+	return append(lines, linePrefix+scratchEndMarker)
+}
+
+// stripScratch removes every existing scratch output section from lines,
+// leaving the rest of the file untouched.
+func stripScratch(lines []string, linePrefix string) []string {
+	var out []string
+	inScratch := false
+	scratchEndLine := linePrefix + scratchEndMarker
+	for _, line := range lines {
+		if inScratch {
+			if line == scratchEndLine {
+				inScratch = false
+			}
+			continue
+		}
+		if _, ok := scratchMarkerName(line, linePrefix); ok {
+			inScratch = true
+			continue
+		}
+		out = append(out, line)
+	}
+	return out
+}
+
+// rewriteScratch strips any existing scratch sections from lines and
+// inserts a fresh one containing output. For a named target cell, the
+// section is placed right where that cell's body ends: at its "@end" line
+// if it has one, at the following "@cell" line if another cell implicitly
+// closes it first (matching parseCells' own implicit-close rule), or at
+// end-of-file if it runs all the way there unclosed (the last cell in a
+// file being edited). For the whole-file target (targetName == ""), the
+// section is placed at the end of the file, matching the tool's original
+// end-of-file behavior.
+func rewriteScratch(lines []string, linePrefix, targetName, output string) []string {
+	cellStart := linePrefix + "@cell "
+	cellEnd := linePrefix + "@end"
+
+	var out []string
+	var curCell string
+	var open bool // true while curCell names a cell whose close hasn't been seen yet
+	inserted := false
+	insertIfTarget := func() {
+		if open && curCell == targetName {
+			out = append(out, scratchBlockLines(linePrefix, targetName, output)...)
+			inserted = true
+		}
+		open = false
+	}
+	for _, line := range stripScratch(lines, linePrefix) {
+		if strings.HasPrefix(line, cellStart) {
+			insertIfTarget() // a following "@cell" implicitly closes the previous one
+			curCell = strings.TrimSpace(strings.TrimPrefix(line, cellStart))
+			open = true
+			out = append(out, line)
+			continue
+		}
+		out = append(out, line)
+		if strings.TrimSpace(line) == cellEnd {
+			insertIfTarget()
+		}
+	}
+	insertIfTarget() // the last cell, if it ran to EOF unclosed
+	if !inserted {
+		out = append(out, scratchBlockLines(linePrefix, targetName, output)...)
+	}
+	return out
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// pipelineShell joins a comma-separated list of shell commands into a
+// single shell pipeline, e.g. "jq .,column -t -s '|'" becomes
+// "jq . | column -t -s '|'", so users can name a -format/-format-err
+// pipeline without pipescratch having to know any of the tools involved.
+func pipelineShell(spec string) string {
+	stages := strings.Split(spec, ",")
+	for i, s := range stages {
+		stages[i] = strings.TrimSpace(s)
+	}
+	return strings.Join(stages, " | ")
+}
+
+// formatOutputOnce runs spec (see pipelineShell) once over the whole of s
+// and returns its stdout. Used for both -oneshot mode, where output is
+// already fully captured by the time it's formatted, and persistent mode,
+// where it's invoked per run over that run's output gathered so far rather
+// than wired as a long-lived pipeline: a formatter like "column -t" or
+// "bat" needs to see all of its input before producing anything, which it
+// would never get from a persistent command's stdout pipe (it only reaches
+// EOF when the process itself exits). Falls back to s unchanged if spec is
+// empty or the formatter itself fails.
+func formatOutputOnce(spec, s string) string {
+	if spec == "" {
+		return s
+	}
+	cmd := exec.Command("sh", "-c", pipelineShell(spec))
+	cmd.Stdin = strings.NewReader(s)
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return s
+	}
+	return out.String()
+}
+
+// formatRunOutput runs a run's raw stdout/stderr through -format/-format-err
+// (see formatOutputOnce) and prefixes the result for the scratch section.
+func formatRunOutput(out, errOut string) string {
+	return prefixLines(formatOutputOnce(*formatFlag, out), *linePrefix) +
+		prefixLines(formatOutputOnce(*formatErrFlag, errOut), *linePrefix)
+}
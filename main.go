@@ -5,11 +5,43 @@
 // the file is updated, its contents are passed to the command's standard input.
 // Each time the command writes to its standard output or error, the file is
 // appended a section at the end with the output as line comments.
+//
+// The file can be divided into named cells, delimited by "@cell name"/"@end"
+// line comments. When cells are present, only the cell selected by the
+// -cell flag, or by an in-file "@run name" directive, is sent to the
+// command, and its output section is pinned right below that cell instead
+// of at end-of-file.
+//
+// -oneshot swaps the long-lived process for a fresh one spawned on every
+// save, for commands built for a single request/response rather than a
+// streaming REPL.
+//
+// A save that arrives while the previous run is still going preempts it
+// instead of letting both runs' output interleave, reporting the
+// cancellation in the scratch section; -timeout bounds how long a single
+// run is given before the same thing happens. Preemption is best-effort for
+// a persistent command: it sends -reset-seq and a SIGINT to the process
+// group, neither of which is guaranteed to interrupt whatever it's
+// currently blocked on (a slow query keeps running underneath).
+//
+// Saves are detected by watching the scratch file's directory rather than
+// the file itself, so editors that save via write-to-temp + rename (vim's
+// :w, VS Code, JetBrains, ...) keep working even though that replaces the
+// file's inode.
+//
+// -format and -format-err each name an external pipeline stdout/stderr are
+// piped through before being written into the scratch section, so e.g. SQL
+// results can be run through "column -t -s '|'" or JSON through "jq .".
+//
+// -restart controls what happens when the persistent command itself exits
+// (a crashed REPL, "\q" in psql, OOM): never (the default) lets pipescratch
+// die with it, while on-failure/always rebuild the pipes and start a fresh
+// copy, replaying the last save against it, with exponential backoff if it
+// keeps exiting right away.
 package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"flag"
 	"fmt"
@@ -17,14 +49,25 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
+	"time"
 
 	"github.com/fsnotify/fsnotify"
 )
 
 var (
-	editorFlag = flag.String("editor", "", "`command` to be invoked with the scratch file location as arg (empty just prints it)")
-	extFlag    = flag.String("ext", "sql", "`extension` for scratch file")
-	linePrefix = flag.String("line-prefix", "-- ", "prefix for each output line")
+	editorFlag     = flag.String("editor", "", "`command` to be invoked with the scratch file location as arg (empty just prints it)")
+	extFlag        = flag.String("ext", "sql", "`extension` for scratch file")
+	linePrefix     = flag.String("line-prefix", "-- ", "prefix for each output line")
+	cellFlag       = flag.String("cell", "", "`name` of the cell to run on save, as delimited by \"-- @cell name\"/\"-- @end\" lines (empty runs the whole file, or the cell named by an in-file \"-- @run name\" directive)")
+	oneshotFlag    = flag.Bool("oneshot", false, "spawn [command] fresh on every save instead of keeping one long-lived process reading a streaming stdin")
+	timeoutFlag    = flag.Duration("timeout", 0, "max `duration` for a single run before it's cancelled same as if a new save had preempted it (0 = no timeout)")
+	resetSeqFlag   = flag.String("reset-seq", "\x03", "byte `sequence` written to a persistent process's stdin to interrupt a run a new save is preempting, alongside a best-effort SIGINT to its process group; neither is guaranteed to stop whatever it's currently doing")
+	resetGraceFlag = flag.Duration("reset-grace", 300*time.Millisecond, "how long to drain a persistent process's output after a reset sequence before starting the next run")
+	killGraceFlag  = flag.Duration("kill-grace", 2*time.Second, "in -oneshot mode, how long to wait after SIGINT before SIGKILLing a run that's being preempted or timed out")
+	formatFlag     = flag.String("format", "", "`pipeline` (a command, or comma-separated commands) stdout is piped through before being written into the scratch section, e.g. \"column -t -s '|'\" or \"jq .,bat -l json\"")
+	formatErrFlag  = flag.String("format-err", "", "like -format, but for stderr")
+	restartFlag    = flag.String("restart", restartNever, "restart `policy` for the persistent command when it exits: never, on-failure, or always")
 )
 
 func main() {
@@ -59,23 +102,75 @@ func main() {
 
 	watcher, err := fsnotify.NewWatcher()
 	try(err)
-	try(watcher.Add(f.Name()))
+	watchScratch(watcher, f.Name())
 
-	cmd := exec.CommandContext(ctx, flag.Args()[0], flag.Args()[1:]...)
-	cmdIn, err := cmd.StdinPipe()
-	try(err)
-	cmdOut, err := cmd.StdoutPipe()
-	try(err)
-	cmdErr, err := cmd.StderrPipe()
-	try(err)
-	try(cmd.Start())
+	if *oneshotFlag {
+		runOneshot(ctx, f, watcher, flag.Args())
+		return
+	}
+
+	proc := startProcess(ctx, flag.Args())
+	cmdIn := proc.cmdIn
+	outLines := proc.outLines
+	errLines := proc.errLines
+	restartAttempt := 0
+	lastStart := time.Now()
 
-	outLines := make(chan string)
-	go readLines(outLines, cmdOut)
-	errLines := make(chan string)
-	go readLines(errLines, cmdErr)
+	// currOut/currErr accumulate the current run's raw output, unprefixed and
+	// unformatted, so formatRunOutput can be (re-)run over the whole of it so
+	// far on each write, rather than wiring -format/-format-err as a
+	// long-lived pipeline a persistent command's stdout never closes. currMeta
+	// holds pipescratch's own status lines (already prefixed), kept separate
+	// so they aren't fed through the user's formatter.
+	var currOut, currErr, currMeta string
+	var curTarget string
+	var runCancel context.CancelFunc
+	var runStart time.Time
+	var runDone <-chan struct{} // non-nil while a run's -timeout clock is ticking
 
-	var currOut, currErr string
+	startRun := func() {
+		toRun, target := readRunInput(f, false)
+
+		// Always terminate with a newline: toRun is a cell's body lines with
+		// no trailing blank element, and a persistent process reading lines
+		// off its stdin (e.g. sqlite3, psql) never sees the last one without it.
+		_, err := io.WriteString(cmdIn, strings.Join(toRun, "\n")+"\n")
+		try(err)
+
+		currOut, currErr, currMeta = "", "", ""
+		curTarget = target
+		runStart = time.Now()
+		runCtx, cancel := withRunTimeout(ctx)
+		runCancel = cancel
+		runDone = runCtx.Done()
+	}
+
+	// preempt cancels the in-flight run (if any), reporting why, so a new
+	// one can start without the old run's trailing output leaking into it.
+	// It signals the process group in addition to writing -reset-seq, since
+	// the latter alone only reaches a REPL that reads control bytes from its
+	// own input loop rather than whatever it's currently blocked on.
+	preempt := func(reason string) {
+		if runCancel == nil {
+			return
+		}
+		runCancel()
+		runCancel, runDone = nil, nil
+
+		// Best-effort, like interruptGroup: if the process already died (a
+		// save racing its exit), cmdIn is a broken pipe and this write fails,
+		// but that must not be fatal here - proc.exited is what's meant to
+		// carry that case forward into -restart's recovery path, and a panic
+		// on this write would short-circuit it.
+		interruptGroup(proc)
+		io.WriteString(cmdIn, *resetSeqFlag)
+		drainFor(outLines, errLines, *resetGraceFlag)
+
+		elapsed := time.Since(runStart)
+		currMeta += fmt.Sprintf("%s[cancelled after %s: %s]\n", *linePrefix, elapsed.Round(time.Millisecond), reason)
+		writeScratchSection(f, watcher, curTarget, formatRunOutput(currOut, currErr)+currMeta)
+		currOut, currErr, currMeta = "", "", ""
+	}
 
 	for {
 		select {
@@ -84,66 +179,62 @@ func main() {
 				outLines = nil
 				continue
 			}
-			currOut += *linePrefix + line + "\n"
+			currOut += line + "\n"
 
 		case line, ok := <-errLines:
 			if !ok {
 				errLines = nil
 				continue
 			}
-			currErr += *linePrefix + line + "\n"
+			currErr += line + "\n"
 
 		case ev := <-watcher.Events:
-			if ev.Op&fsnotify.Write != fsnotify.Write {
+			if reopenIfReplaced(&f, f.Name(), ev) {
+				preempt("new save")
+				startRun()
 				continue
 			}
-			_, err := f.Seek(0, 0)
-			try(err)
-
-			_, err = io.Copy(cmdIn, f)
-			try(err)
+			if ev.Name != f.Name() || ev.Op&fsnotify.Write != fsnotify.Write {
+				continue
+			}
+			preempt("new save")
+			startRun()
+			continue
 
-			currOut, currErr = "", ""
+		case <-runDone:
+			preempt("timeout")
+			runDone = nil
 			continue
 
-		case err := <-watcher.Errors:
-			panic(err)
-		}
+		case waitErr := <-proc.exited:
+			status := exitStatusDesc(waitErr)
+			if *restartFlag == restartNever || (*restartFlag == restartOnFailure && waitErr == nil) {
+				panic(fmt.Errorf("command exited: %s", status))
+			}
 
-		_, err := f.Seek(0, 0)
-		try(err)
+			runCancel, runDone = nil, nil
+			currMeta += fmt.Sprintf("%s[process exited: %s, restarting...]\n", *linePrefix, status)
+			writeScratchSection(f, watcher, curTarget, formatRunOutput(currOut, currErr)+currMeta)
+			currOut, currErr, currMeta = "", "", ""
 
-		oldContents := bufio.NewReader(f)
-		var newContents bytes.Buffer
-		for {
-			line, err := oldContents.ReadString('\n')
-			if line == (*linePrefix)+"~~ scratch ~~\n" {
-				break
-			}
-			newContents.WriteString(line)
-			if err != nil {
-				newContents.WriteString("\n")
-				break
+			if time.Since(lastStart) < backoffResetAfter {
+				restartAttempt++
+			} else {
+				restartAttempt = 0
 			}
-		}
-		fmt.Fprintf(&newContents, (*linePrefix)+"~~ scratch ~~\n%s%s", currOut, currErr)
+			time.Sleep(backoffDelay(restartAttempt))
 
-		_, err = f.Seek(0, 0)
-		try(err)
-		try(f.Truncate(0))
-		select {
-		case <-watcher.Events:
-		case err := <-watcher.Errors:
-			panic(err)
-		}
+			lastStart = time.Now()
+			proc = startProcess(ctx, flag.Args())
+			cmdIn, outLines, errLines = proc.cmdIn, proc.outLines, proc.errLines
+			startRun() // replay the last save against the fresh process
+			continue
 
-		_, err = io.Copy(f, &newContents)
-		try(err)
-		select {
-		case <-watcher.Events:
 		case err := <-watcher.Errors:
 			panic(err)
 		}
+
+		writeScratchSection(f, watcher, curTarget, formatRunOutput(currOut, currErr)+currMeta)
 	}
 }
 
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// oneshotResult is what an execOneshot run reports back to runOneshot's
+// select loop.
+type oneshotResult struct {
+	gen            int
+	target         string
+	stdout, stderr string
+	cancelled      bool
+	reason         string
+	elapsed        time.Duration
+}
+
+// runOneshot implements -oneshot mode: instead of keeping one long-lived
+// process reading a streaming stdin, it spawns a fresh copy of argv on every
+// save, feeds it the scratch file's contents (or the targeted cell's) on
+// stdin, and writes its combined stdout/stderr back into the scratch
+// section. A save that arrives while the previous run is still going
+// preempts it instead of letting both runs' output interleave.
+func runOneshot(ctx context.Context, f *os.File, watcher *fsnotify.Watcher, argv []string) {
+	results := make(chan oneshotResult)
+
+	var gen int
+	var cancelCurrent context.CancelFunc
+
+	start := func() {
+		toRun, target := readRunInput(f, true)
+		gen++
+		runCtx, cancel := withRunTimeout(ctx)
+		cancelCurrent = cancel
+		go execOneshot(runCtx, gen, argv, strings.Join(toRun, "\n"), target, results)
+	}
+
+	preempt := func() {
+		if cancelCurrent == nil {
+			return
+		}
+		cancelCurrent()
+		cancelCurrent = nil
+	}
+
+	for {
+		select {
+		case ev := <-watcher.Events:
+			if reopenIfReplaced(&f, f.Name(), ev) {
+				preempt()
+				start()
+				continue
+			}
+			if ev.Name != f.Name() || ev.Op&fsnotify.Write != fsnotify.Write {
+				continue
+			}
+			preempt()
+			start()
+			continue
+
+		case res := <-results:
+			if res.gen != gen {
+				continue // stale result from a run we've since preempted
+			}
+			cancelCurrent = nil
+			out := formatRunOutput(res.stdout, res.stderr)
+			if res.cancelled {
+				out += fmt.Sprintf("%s[cancelled after %s: %s]\n", *linePrefix, res.elapsed.Round(time.Millisecond), res.reason)
+			}
+			writeScratchSection(f, watcher, res.target, out)
+			continue
+
+		case err := <-watcher.Errors:
+			panic(err)
+		}
+	}
+}
+
+// execOneshot runs one copy of argv to completion or cancellation. On
+// cancellation (a new save preempting it, or ctx's -timeout expiring) it
+// sends SIGINT and gives the process -kill-grace to exit before SIGKILLing
+// it.
+func execOneshot(ctx context.Context, gen int, argv []string, input, target string, results chan<- oneshotResult) {
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin = strings.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	start := time.Now()
+	try(cmd.Start())
+
+	waitErr := make(chan error, 1)
+	go func() { waitErr <- cmd.Wait() }()
+
+	select {
+	case <-waitErr:
+		results <- oneshotResult{gen: gen, target: target, stdout: stdout.String(), stderr: stderr.String()}
+
+	case <-ctx.Done():
+		reason := "new save"
+		if ctx.Err() == context.DeadlineExceeded {
+			reason = "timeout"
+		}
+		cmd.Process.Signal(syscall.SIGINT)
+		select {
+		case <-waitErr:
+		case <-time.After(*killGraceFlag):
+			cmd.Process.Kill()
+			<-waitErr
+		}
+		results <- oneshotResult{
+			gen: gen, target: target,
+			stdout: stdout.String(), stderr: stderr.String(),
+			cancelled: true, reason: reason, elapsed: time.Since(start),
+		}
+	}
+}
+
+// prefixLines prefixes every line in s with prefix, terminating the last
+// one with a newline even if s didn't have one.
+func prefixLines(s, prefix string) string {
+	if s == "" {
+		return ""
+	}
+	var b strings.Builder
+	for _, l := range strings.Split(strings.TrimSuffix(s, "\n"), "\n") {
+		b.WriteString(prefix)
+		b.WriteString(l)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// writeScratchSection rewrites f's scratch section for target with output,
+// via rewriteScratch. It drains the watcher events the write itself
+// triggers so the main loop doesn't mistake them for a new save.
+func writeScratchSection(f *os.File, watcher *fsnotify.Watcher, target, output string) {
+	_, err := f.Seek(0, 0)
+	try(err)
+	contents, err := ioutil.ReadAll(f)
+	try(err)
+
+	newLines := rewriteScratch(strings.Split(string(contents), "\n"), *linePrefix, target, output)
+	var newContents bytes.Buffer
+	newContents.WriteString(strings.Join(newLines, "\n"))
+
+	_, err = f.Seek(0, 0)
+	try(err)
+	try(f.Truncate(0))
+	drainSelfEvent(watcher, f.Name())
+
+	_, err = io.Copy(f, &newContents)
+	try(err)
+	drainSelfEvent(watcher, f.Name())
+}
+
+// drainSelfEvent waits for the next watcher event on path, discarding any
+// unrelated events from sibling files in the same directory along the way
+// (watchScratch watches the whole directory, not just path).
+func drainSelfEvent(watcher *fsnotify.Watcher, path string) {
+	for {
+		select {
+		case ev := <-watcher.Events:
+			if ev.Name == path {
+				return
+			}
+		case err := <-watcher.Errors:
+			panic(err)
+		}
+	}
+}
+
+// readRunInput reads f's current contents and returns the lines to feed the
+// command (the whole file, or just the targeted cell's body) along with the
+// target cell name ("" for the whole file). If stripOldScratch is set,
+// existing scratch output sections are removed first, so they aren't fed
+// back into the command as if they were part of the query.
+func readRunInput(f *os.File, stripOldScratch bool) (toRun []string, target string) {
+	_, err := f.Seek(0, 0)
+	try(err)
+	contents, err := ioutil.ReadAll(f)
+	try(err)
+	lines := strings.Split(string(contents), "\n")
+	if stripOldScratch {
+		lines = stripScratch(lines, *linePrefix)
+	}
+
+	target = *cellFlag
+	if target == "" {
+		target = runDirective(lines, *linePrefix)
+	}
+	toRun = lines
+	if target != "" {
+		if c := findCell(parseCells(lines, *linePrefix), target); c != nil {
+			toRun = lines[c.bodyStart:c.bodyEnd]
+		} else {
+			target = ""
+		}
+	}
+	return toRun, target
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// Values for -restart.
+const (
+	restartNever     = "never"
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+)
+
+// process wraps the long-lived child command used in persistent (non
+// -oneshot) mode: its stdin pipe, its line-reading goroutines, a channel
+// reporting when it exits, and its process group id (for interruptGroup), so
+// main can rebuild it under -restart without duplicating the wiring at each
+// restart.
+type process struct {
+	cmdIn    io.WriteCloser
+	outLines chan string
+	errLines chan string
+	exited   chan error
+	pgid     int
+}
+
+// startProcess spawns argv as the persistent command in its own process
+// group (so interruptGroup can signal it and anything it spawns without
+// also hitting pipescratch itself), wiring its stdout and stderr into fresh
+// line channels, and starts watching for it to exit.
+func startProcess(ctx context.Context, argv []string) *process {
+	cmd := exec.CommandContext(ctx, argv[0], argv[1:]...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmdIn, err := cmd.StdinPipe()
+	try(err)
+	cmdOut, err := cmd.StdoutPipe()
+	try(err)
+	cmdErr, err := cmd.StderrPipe()
+	try(err)
+	try(cmd.Start())
+
+	p := &process{
+		cmdIn:    cmdIn,
+		outLines: make(chan string),
+		errLines: make(chan string),
+		exited:   make(chan error, 1),
+		pgid:     cmd.Process.Pid,
+	}
+	go readLines(p.outLines, cmdOut)
+	go readLines(p.errLines, cmdErr)
+	go func() { p.exited <- cmd.Wait() }()
+	return p
+}
+
+// interruptGroup sends SIGINT to p's process group, best-effort, so a run
+// blocking on slow work (e.g. a slow query) has a chance to unwind instead
+// of running to completion untouched by -reset-seq's plain pipe byte, which
+// most real REPLs don't wire up to an interrupt of whatever they're
+// currently blocked on. Not guaranteed: some programs ignore SIGINT, or
+// don't forward it on to a child doing the actual work.
+func interruptGroup(p *process) {
+	syscall.Kill(-p.pgid, syscall.SIGINT)
+}
+
+// exitStatusDesc describes a persistent command's exit for the scratch
+// section, e.g. "exit status 1" or "signal: killed"; nil (a clean exit)
+// reads as "exited cleanly".
+func exitStatusDesc(err error) string {
+	if err == nil {
+		return "exited cleanly"
+	}
+	return err.Error()
+}
+
+// backoffResetAfter is how long a restarted process must stay up before a
+// further exit is treated as a fresh failure rather than part of the same
+// crash loop.
+const backoffResetAfter = 10 * time.Second
+
+// backoffDelay returns an exponential backoff delay for the nth consecutive
+// restart attempt (0-indexed), capped at a few seconds, to avoid spinning
+// tightly on a command that crashes immediately on every restart.
+func backoffDelay(attempt int) time.Duration {
+	const (
+		base = 250 * time.Millisecond
+		max  = 8 * time.Second
+	)
+	d := base
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
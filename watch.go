@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchScratch arms watcher on path's parent directory rather than path
+// itself. Editors that save via write-to-temp + rename (vim's :w, VS Code,
+// JetBrains, ...) replace the file's inode, which would silently stop
+// fsnotify from delivering further events on a file-only watch bound to
+// the old inode; a directory watch keeps reporting writes and renames
+// under the same name regardless of which inode currently backs it.
+func watchScratch(watcher *fsnotify.Watcher, path string) {
+	try(watcher.Add(filepath.Dir(path)))
+}
+
+// reopenIfReplaced reports whether ev announces that path's inode was
+// replaced (a rename-into-place, or a remove+create) rather than just
+// written to in place. If so, it closes *f and reopens path into a fresh
+// *os.File so the caller's subsequent Seek/Truncate/Copy calls target the
+// new file; the caller should then treat ev like an ordinary save. A Rename
+// event that leaves nothing at path (the file moved away, its replacement
+// not yet created) reports false and keeps *f; the Create that follows
+// reopens it.
+func reopenIfReplaced(f **os.File, path string, ev fsnotify.Event) bool {
+	if ev.Name != path || ev.Op&(fsnotify.Create|fsnotify.Rename) == 0 {
+		return false
+	}
+
+	newF, err := os.OpenFile(path, os.O_RDWR, 0o600)
+	if os.IsNotExist(err) {
+		return false
+	}
+	try(err)
+	(*f).Close()
+	*f = newF
+
+	return true
+}